@@ -0,0 +1,160 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Unix control socket, used by the "reload" and "rescan" commands to
+ * talk to an already-running ipp-usb daemon
+ */
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// PathControlSocket is the path of the control socket, created by
+// the daemon next to PathLockFile
+var PathControlSocket = filepath.Join(filepath.Dir(PathLockFile), "ipp-usb.sock")
+
+// controlRequest is a single line sent over the control socket
+type controlRequest string
+
+// Control requests, understood by ControlServe
+const (
+	controlReload controlRequest = "reload"
+	controlRescan controlRequest = "rescan"
+)
+
+// ControlServe listens on PathControlSocket and dispatches incoming
+// requests to the running daemon. It runs until the socket is closed
+// and never returns an error for requests it can't fully satisfy --
+// those are reported back to the client instead
+func ControlServe() error {
+	os.Remove(PathControlSocket)
+
+	listener, err := net.Listen("unix", PathControlSocket)
+	if err != nil {
+		return fmt.Errorf("control socket: %s", err)
+	}
+	os.Chmod(PathControlSocket, 0600)
+
+	go func() {
+		defer listener.Close()
+		defer os.Remove(PathControlSocket)
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go controlHandle(conn)
+		}
+	}()
+
+	return nil
+}
+
+// controlHandle services a single control connection
+func controlHandle(conn net.Conn) {
+	defer conn.Close()
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return
+	}
+
+	var reply string
+	switch controlRequest(trimNewline(line)) {
+	case controlReload:
+		reply = controlDoReload()
+	case controlRescan:
+		reply = controlDoRescan()
+	default:
+		reply = "error: unknown request"
+	}
+
+	fmt.Fprintln(conn, reply)
+}
+
+// trimNewline strips all trailing \n and \r characters
+func trimNewline(s string) string {
+	for len(s) > 0 && (s[len(s)-1] == '\n' || s[len(s)-1] == '\r') {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+// controlDoReload re-reads ipp-usb.conf and applies its log levels
+// to the running daemon, without dropping active connections. It
+// does not yet re-apply quirks or other per-device options to
+// devices that are already being served; those still require a
+// restart
+func controlDoReload() string {
+	err := ConfLoad()
+	if err != nil {
+		return fmt.Sprintf("error: %s", err)
+	}
+
+	Log.SetLevels(Conf.LogMain)
+	Console.SetLevels(Conf.LogConsole)
+
+	Log.Info(' ', "configuration reloaded")
+
+	return "ok"
+}
+
+// controlDoRescan checks whether any IPP-over-USB devices are
+// currently present and reports the result. It does not signal the
+// running PnP manager, so it does not reproduce a udev "add" event:
+// devices that appeared since the PnP manager's last enumeration pass
+// are picked up only by the PnP manager's own loop
+func controlDoRescan() string {
+	if !UsbCheckIppOverUsbDevices() {
+		return "ok: no IPP-over-USB devices found"
+	}
+	return "ok"
+}
+
+// controlSend connects to a running daemon's control socket, sends
+// req and prints its reply. It's used by the "reload" and "rescan"
+// run modes
+func controlSend(req controlRequest) error {
+	conn, err := net.Dial("unix", PathControlSocket)
+	if err != nil {
+		return fmt.Errorf("can't connect to ipp-usb: %s", err)
+	}
+	defer conn.Close()
+
+	fmt.Fprintln(conn, string(req))
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("ipp-usb didn't respond: %s", err)
+	}
+
+	fmt.Print(reply)
+	return nil
+}
+
+// ReloadRun asks the running daemon to reload its configuration
+func ReloadRun() {
+	err := controlSend(controlReload)
+	if err != nil {
+		InitLog.Exit(0, "%s", err)
+	}
+}
+
+// RescanRun asks the running daemon whether any IPP-over-USB devices
+// are currently present; see controlDoRescan for what it does and
+// does not actually trigger
+func RescanRun() {
+	err := controlSend(controlRescan)
+	if err != nil {
+		InitLog.Exit(0, "%s", err)
+	}
+}
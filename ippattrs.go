@@ -0,0 +1,224 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * A minimal IPP client, just enough to issue Get-Printer-Attributes
+ * and decode the handful of attributes the "monitor" run mode cares
+ * about. Encoding follows RFC 8010.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// IPP value tags, as defined by RFC 8010 3.5.2, restricted to the
+// ones this client needs to send or decode
+const (
+	ippTagEndOfAttributes byte = 0x03
+	ippTagInteger         byte = 0x21
+	ippTagEnum            byte = 0x23
+	ippTagCharset         byte = 0x47
+	ippTagNaturalLanguage byte = 0x48
+	ippTagURI             byte = 0x45
+	ippTagKeyword         byte = 0x44
+	ippTagNameWithoutLang byte = 0x42
+)
+
+// IPP group tags
+const (
+	ippTagOperationGroup byte = 0x01
+	ippTagPrinterGroup   byte = 0x04
+)
+
+// ippOpGetPrinterAttributes is the Get-Printer-Attributes operation-id
+const ippOpGetPrinterAttributes uint16 = 0x000b
+
+// ippBuildGetPrinterAttributes builds an IPP Get-Printer-Attributes
+// request for the printer reachable at uri
+func ippBuildGetPrinterAttributes(uri string, requestID uint32) []byte {
+	var buf bytes.Buffer
+
+	binary.Write(&buf, binary.BigEndian, uint16(0x0101)) // version 1.1
+	binary.Write(&buf, binary.BigEndian, ippOpGetPrinterAttributes)
+	binary.Write(&buf, binary.BigEndian, requestID)
+
+	buf.WriteByte(ippTagOperationGroup)
+	ippWriteAttr(&buf, ippTagCharset, "attributes-charset", "utf-8")
+	ippWriteAttr(&buf, ippTagNaturalLanguage, "attributes-natural-language", "en")
+	ippWriteAttr(&buf, ippTagURI, "printer-uri", uri)
+	ippWriteAttr(&buf, ippTagKeyword, "requested-attributes", "printer-state")
+	ippWriteAttrValue(&buf, ippTagKeyword, "printer-state-reasons")
+	ippWriteAttrValue(&buf, ippTagKeyword, "queued-job-count")
+	ippWriteAttrValue(&buf, ippTagKeyword, "marker-names")
+	ippWriteAttrValue(&buf, ippTagKeyword, "marker-levels")
+
+	buf.WriteByte(ippTagEndOfAttributes)
+
+	return buf.Bytes()
+}
+
+// ippWriteAttr writes a single-valued attribute, with its name
+func ippWriteAttr(buf *bytes.Buffer, tag byte, name, value string) {
+	buf.WriteByte(tag)
+	binary.Write(buf, binary.BigEndian, uint16(len(name)))
+	buf.WriteString(name)
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.WriteString(value)
+}
+
+// ippWriteAttrValue appends an additional value to the previously
+// written attribute (empty name, per RFC 8010 3.1.3)
+func ippWriteAttrValue(buf *bytes.Buffer, tag byte, value string) {
+	buf.WriteByte(tag)
+	binary.Write(buf, binary.BigEndian, uint16(0))
+	binary.Write(buf, binary.BigEndian, uint16(len(value)))
+	buf.WriteString(value)
+}
+
+// ippAttr is a single decoded IPP attribute value
+type ippAttr struct {
+	tag  byte
+	name string
+	data []byte
+}
+
+// ippParseResponse decodes an IPP response into its printer-group
+// attributes, keyed by name. Multi-valued attributes appear as
+// repeated entries in the returned slice, in wire order
+func ippParseResponse(data []byte) (map[string][]ippAttr, error) {
+	r := bytes.NewReader(data)
+
+	var version uint16
+	var status uint16
+	var requestID uint32
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, fmt.Errorf("ipp: truncated header: %s", err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &status); err != nil {
+		return nil, fmt.Errorf("ipp: truncated header: %s", err)
+	}
+	if err := binary.Read(r, binary.BigEndian, &requestID); err != nil {
+		return nil, fmt.Errorf("ipp: truncated header: %s", err)
+	}
+
+	attrs := make(map[string][]ippAttr)
+	group := byte(0)
+	lastName := ""
+
+	for {
+		tag, err := r.ReadByte()
+		if err == io.EOF || tag == ippTagEndOfAttributes {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("ipp: %s", err)
+		}
+
+		if tag < 0x10 {
+			// Begin-attribute-group-tag
+			group = tag
+			continue
+		}
+
+		name, err := ippReadValue(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := ippReadValue(r)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(name) != 0 {
+			lastName = string(name)
+		}
+
+		if group == ippTagPrinterGroup && lastName != "" {
+			attrs[lastName] = append(attrs[lastName], ippAttr{tag: tag, name: lastName, data: value})
+		}
+	}
+
+	return attrs, nil
+}
+
+// ippReadValue reads a length-prefixed field (name or value)
+func ippReadValue(r *bytes.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, fmt.Errorf("ipp: %s", err)
+	}
+
+	value := make([]byte, length)
+	if length > 0 {
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, fmt.Errorf("ipp: %s", err)
+		}
+	}
+
+	return value, nil
+}
+
+// ippAttrInt decodes a single integer/enum-valued attribute, in
+// big-endian 4-byte IPP wire format
+func ippAttrInt(attrs map[string][]ippAttr, name string) (int, bool) {
+	values := attrs[name]
+	if len(values) == 0 || len(values[0].data) != 4 {
+		return 0, false
+	}
+	return int(int32(binary.BigEndian.Uint32(values[0].data))), true
+}
+
+// ippAttrStrings decodes a (possibly multi-valued) keyword/text
+// attribute into a list of strings
+func ippAttrStrings(attrs map[string][]ippAttr, name string) []string {
+	values := attrs[name]
+	list := make([]string, 0, len(values))
+	for _, v := range values {
+		list = append(list, string(v.data))
+	}
+	return list
+}
+
+// ippAttrInts decodes a multi-valued integer attribute
+func ippAttrInts(attrs map[string][]ippAttr, name string) []int {
+	values := attrs[name]
+	list := make([]int, 0, len(values))
+	for _, v := range values {
+		if len(v.data) == 4 {
+			list = append(list, int(int32(binary.BigEndian.Uint32(v.data))))
+		}
+	}
+	return list
+}
+
+// ippHTTPClient is used for all Get-Printer-Attributes requests.
+// A modest timeout keeps a single unresponsive device from stalling
+// the whole polling loop
+var ippHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// ippGetPrinterAttributes sends a Get-Printer-Attributes request to
+// the printer at uri and returns its printer-group attributes
+func ippGetPrinterAttributes(uri string, requestID uint32) (map[string][]ippAttr, error) {
+	body := ippBuildGetPrinterAttributes(uri, requestID)
+
+	resp, err := ippHTTPClient.Post(uri, "application/ipp", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return ippParseResponse(data)
+}
@@ -0,0 +1,143 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * JSON output for "check" and "status" modes
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// checkDeviceJSON is a single device entry, as emitted by
+// "check -json"
+type checkDeviceJSON struct {
+	Bus        int    `json:"bus"`
+	Address    int    `json:"address"`
+	Vendor     uint16 `json:"vendor"`
+	Product    uint16 `json:"product"`
+	Model      string `json:"model"`
+	Ieee1284ID string `json:"ieee1284_id"`
+	ConfigOK   bool   `json:"config_ok"`
+}
+
+// printCheckJSON prints the list of discovered IPP-over-USB devices
+// as a JSON array, for "check -json"
+func printCheckJSON(list []UsbDeviceDesc, checkErr error) {
+	devices := make([]checkDeviceJSON, 0, len(list))
+
+	for _, dev := range list {
+		d := checkDeviceJSON{
+			Bus:     dev.UsbAddr.Bus,
+			Address: dev.UsbAddr.Address,
+		}
+
+		info, infoErr := dev.GetUsbDeviceInfo()
+		if infoErr == nil {
+			d.Vendor = info.Vendor
+			d.Product = info.Product
+			d.Model = info.MfgAndProduct
+			d.Ieee1284ID = info.Ieee1284ID
+		}
+
+		// checkErr reflects the global enumeration pass; infoErr is
+		// specific to this device. Either makes this device's entry
+		// not OK, so two devices on the same run can disagree
+		d.ConfigOK = checkErr == nil && infoErr == nil
+
+		devices = append(devices, d)
+	}
+
+	data, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		InitLog.Exit(0, "%s", err)
+	}
+
+	fmt.Println(string(data))
+}
+
+// statusRecordJSON is a single device entry, as emitted by
+// "status -json"
+type statusRecordJSON struct {
+	Device    string `json:"device"`
+	Port      int    `json:"port,omitempty"`
+	Model     string `json:"model,omitempty"`
+	Jobs      int    `json:"jobs,omitempty"`
+	LastError string `json:"last_error,omitempty"`
+	Raw       string `json:"raw"`
+}
+
+// statusLineRx roughly matches the status lines written to
+// PathStatusFile: "<device> ... port=<N> ... model=<...> jobs=<N>
+// error=<...>". Fields that are absent from a given line are simply
+// left zero-valued in the resulting record. A field's value is
+// either a double-quoted string (which may contain spaces, as model
+// names do) or a single run of non-space characters
+var statusLineRx = regexp.MustCompile(`^(\S+)`)
+var statusFieldRx = regexp.MustCompile(`(\w+)=("[^"]*"|\S+)`)
+
+// parseStatusLine decodes a single line of PathStatusFile into a
+// statusRecordJSON. Unrecognized fields are ignored; the original
+// line is always preserved in Raw, so nothing is silently lost
+func parseStatusLine(line string) statusRecordJSON {
+	rec := statusRecordJSON{Raw: line}
+
+	if m := statusLineRx.FindStringSubmatch(line); m != nil {
+		rec.Device = m[1]
+	}
+
+	for _, m := range statusFieldRx.FindAllStringSubmatch(line, -1) {
+		key, val := m[1], m[2]
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			val = val[1 : len(val)-1]
+		}
+
+		switch key {
+		case "port":
+			fmt.Sscanf(val, "%d", &rec.Port)
+		case "model":
+			rec.Model = val
+		case "jobs":
+			fmt.Sscanf(val, "%d", &rec.Jobs)
+		case "error":
+			rec.LastError = val
+		}
+	}
+
+	return rec
+}
+
+// statusJSON is the top-level object printed by "status -json": the
+// per-device status lines, plus the latest "monitor" health snapshot
+// when one is available
+type statusJSON struct {
+	Devices []statusRecordJSON `json:"devices"`
+	Health  []PrinterHealth    `json:"health,omitempty"`
+}
+
+// printStatusJSON parses PathStatusFile and prints it, together with
+// the latest monitor health snapshot (if any), as JSON, for
+// "status -json"
+func printStatusJSON(lines [][]byte) {
+	records := make([]statusRecordJSON, 0, len(lines))
+	for _, line := range lines {
+		records = append(records, parseStatusLine(string(line)))
+	}
+
+	health, _ := loadMonitorSnapshot()
+
+	out := statusJSON{Devices: records, Health: health}
+
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		InitLog.Exit(0, "%s", err)
+	}
+
+	fmt.Fprintln(os.Stdout, string(data))
+}
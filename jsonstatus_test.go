@@ -0,0 +1,57 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ */
+
+package main
+
+import "testing"
+
+func TestParseStatusLine(t *testing.T) {
+	type testCase struct {
+		line string
+		want statusRecordJSON
+	}
+
+	cases := []testCase{
+		{
+			line: "001:002 port=60000 model=\"HP LaserJet\" jobs=3",
+			want: statusRecordJSON{
+				Device: "001:002",
+				Port:   60000,
+				Model:  "HP LaserJet",
+				Jobs:   3,
+				Raw:    "001:002 port=60000 model=\"HP LaserJet\" jobs=3",
+			},
+		},
+		{
+			line: "001:002 model=EPSON_WF-3620",
+			want: statusRecordJSON{
+				Device: "001:002",
+				Model:  "EPSON_WF-3620",
+				Raw:    "001:002 model=EPSON_WF-3620",
+			},
+		},
+		{
+			line: "001:002 error=timeout",
+			want: statusRecordJSON{
+				Device:    "001:002",
+				LastError: "timeout",
+				Raw:       "001:002 error=timeout",
+			},
+		},
+		{
+			line: "",
+			want: statusRecordJSON{Raw: ""},
+		},
+	}
+
+	for _, c := range cases {
+		got := parseStatusLine(c.line)
+		if got != c.want {
+			t.Errorf("parseStatusLine(%q):\n got  %+v\n want %+v",
+				c.line, got, c.want)
+		}
+	}
+}
@@ -14,6 +14,9 @@ import (
 	"io/ioutil"
 	"os"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const usageText = `Usage:
@@ -28,9 +31,35 @@ Modes are:
                   ignored
     check       - check configuration and exit
     status      - print ipp-usb status and exit
+    monitor     - like standalone, but also periodically polls
+                  attached devices for health (state, errors,
+                  marker levels) and writes a status snapshot
+    reload      - ask the running ipp-usb daemon to re-read
+                  ipp-usb.conf and apply its log levels, then exit.
+                  Quirks and other per-device options still require
+                  a restart to take effect
+    rescan      - ask the running ipp-usb daemon whether any
+                  IPP-over-USB devices are currently present. This
+                  does not force the daemon to re-serve devices that
+                  appeared after it last enumerated; it only reports
+                  presence and relies on the daemon's own enumeration
+                  loop to pick new devices up
 
 Options are
     -bg         - run in background (ignored in debug mode)
+    -interval=N - health polling interval in seconds, for monitor
+                  mode only (default 30)
+    -json       - print machine-readable JSON instead of a human
+                  table; for check and status modes, and for the
+                  per-tick output of monitor mode. "status -json"
+                  also includes the latest monitor health snapshot,
+                  when monitor mode is (or was) running
+    -netns=PATH - check at startup that the given network namespace
+                  (/run/netns/<name> or a PID) exists and is
+                  enterable, and exit with an error if it is not.
+                  Device HTTP listeners are not bound into it; they
+                  stay in ipp-usb's own namespace. Valid in standalone
+                  and udev modes only
 `
 
 // RunMode represents the program run mode
@@ -43,6 +72,9 @@ const (
 	RunDebug
 	RunCheck
 	RunStatus
+	RunMonitor
+	RunReload
+	RunRescan
 )
 
 // String returns RunMode name
@@ -60,6 +92,12 @@ func (m RunMode) String() string {
 		return "check"
 	case RunStatus:
 		return "status"
+	case RunMonitor:
+		return "monitor"
+	case RunReload:
+		return "reload"
+	case RunRescan:
+		return "rescan"
 	}
 
 	return fmt.Sprintf("unknown (%d)", int(m))
@@ -67,8 +105,11 @@ func (m RunMode) String() string {
 
 // RunParameters represents the program run parameters
 type RunParameters struct {
-	Mode       RunMode // Run mode
-	Background bool    // Run in background
+	Mode            RunMode       // Run mode
+	Background      bool          // Run in background
+	MonitorInterval time.Duration // Health polling interval, for RunMonitor
+	JSON            bool          // Emit JSON, for RunCheck/RunStatus
+	NetNS           NetNS         // Namespace override, for standalone/udev
 }
 
 // usage prints detailed usage and exits
@@ -100,29 +141,53 @@ func parseArgv() (params RunParameters) {
 
 	// For now, default mode is debug mode. It may change in a future
 	params.Mode = RunDebug
+	params.MonitorInterval = MonitorDefaultInterval
 
 	modes := 0
 	for _, arg := range os.Args[1:] {
-		switch arg {
-		case "-h", "-help", "--help":
+		switch {
+		case arg == "-h" || arg == "-help" || arg == "--help":
 			usage()
-		case "standalone":
+		case arg == "standalone":
 			params.Mode = RunStandalone
 			modes++
-		case "udev":
+		case arg == "udev":
 			params.Mode = RunUdev
 			modes++
-		case "debug":
+		case arg == "debug":
 			params.Mode = RunDebug
 			modes++
-		case "check":
+		case arg == "check":
 			params.Mode = RunCheck
 			modes++
-		case "status":
+		case arg == "status":
 			params.Mode = RunStatus
 			modes++
-		case "-bg":
+		case arg == "monitor":
+			params.Mode = RunMonitor
+			modes++
+		case arg == "reload":
+			params.Mode = RunReload
+			modes++
+		case arg == "rescan":
+			params.Mode = RunRescan
+			modes++
+		case arg == "-bg":
 			params.Background = true
+		case arg == "-json":
+			params.JSON = true
+		case strings.HasPrefix(arg, "-interval="):
+			secs, err := strconv.Atoi(arg[len("-interval="):])
+			if err != nil || secs <= 0 {
+				usageError("Invalid -interval value %q", arg)
+			}
+			params.MonitorInterval = time.Duration(secs) * time.Second
+		case strings.HasPrefix(arg, "-netns="):
+			ns, err := ParseNetNS(arg[len("-netns="):])
+			if err != nil {
+				usageError("%s", err)
+			}
+			params.NetNS = ns
 		default:
 			usageError("Invalid argument %s", arg)
 		}
@@ -140,9 +205,7 @@ func parseArgv() (params RunParameters) {
 }
 
 // printStatus prints status of running ipp-usb daemon, if any
-func printStatus() {
-	running := false
-
+func printStatus(jsonOutput bool) {
 	// Check if ipp-usb is running
 	lock, err := os.OpenFile(PathLockFile,
 		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
@@ -151,18 +214,19 @@ func printStatus() {
 		lock.Close()
 	}
 
-	switch err {
-	case nil:
-		InitLog.Info(0, "ipp-usb is not running")
-	case ErrLockIsBusy:
-		InitLog.Info(0, "ipp-usb is running")
-		running = true
-	default:
-		InitLog.Info(0, "%s", err)
+	if !jsonOutput {
+		switch err {
+		case nil:
+			InitLog.Info(0, "ipp-usb is not running")
+		case ErrLockIsBusy:
+			InitLog.Info(0, "ipp-usb is running")
+		default:
+			InitLog.Info(0, "%s", err)
+		}
 	}
 
 	// Dump ipp-usb status file, if ipp-usb is running
-	if running {
+	if err == ErrLockIsBusy {
 		var text []byte
 
 		status, err := os.OpenFile(PathStatusFile,
@@ -184,7 +248,9 @@ func printStatus() {
 				lines = lines[0 : len(lines)-1]
 			}
 
-			if len(lines) == 0 {
+			if jsonOutput {
+				printStatusJSON(lines)
+			} else if len(lines) == 0 {
 				InitLog.Info(0, "per-device status: empty")
 			} else {
 				InitLog.Info(0, "per-device status:")
@@ -192,9 +258,29 @@ func printStatus() {
 					InitLog.Info(0, "%s", line)
 				}
 			}
+		} else if jsonOutput {
+			printStatusJSON(nil)
 		} else {
 			InitLog.Info(0, "per-device status: %s", err)
 		}
+	} else if jsonOutput {
+		printStatusJSON(nil)
+	}
+
+	// Print the latest monitor health snapshot, if monitor mode is
+	// (or was) running and jsonOutput didn't already fold it in above
+	if !jsonOutput {
+		if health, err := loadMonitorSnapshot(); err == nil && len(health) > 0 {
+			InitLog.Info(0, "printer health (monitor):")
+			for _, h := range health {
+				reasons := "-"
+				if len(h.Reasons) > 0 {
+					reasons = fmt.Sprintf("%v", h.Reasons)
+				}
+				InitLog.Info(0, " %s  %-10s %-10s jobs=%d reasons=%s",
+					h.Addr, h.Model, h.State, h.JobsQueue, reasons)
+			}
+		}
 	}
 }
 
@@ -212,7 +298,9 @@ func main() {
 	// Setup logging
 	if params.Mode != RunDebug &&
 		params.Mode != RunCheck &&
-		params.Mode != RunStatus {
+		params.Mode != RunStatus &&
+		params.Mode != RunReload &&
+		params.Mode != RunRescan {
 		Console.ToNowhere()
 	} else if Conf.ColorConsole {
 		Console.ToColorConsole()
@@ -222,10 +310,25 @@ func main() {
 	Console.SetLevels(Conf.LogConsole)
 	Log.Cc(Console)
 
+	// In RunReload/RunRescan modes, just talk to the running daemon
+	// over the control socket and exit; no USB access is needed for
+	// this. The daemon creates the socket with mode 0600, so only the
+	// daemon's own user (root) can connect to it
+	if params.Mode == RunReload {
+		ReloadRun()
+		os.Exit(0)
+	}
+	if params.Mode == RunRescan {
+		RescanRun()
+		os.Exit(0)
+	}
+
 	// In RunCheck mode, list IPP-over-USB devices
 	if params.Mode == RunCheck {
 		// If we are here, configuration is OK
-		InitLog.Info(0, "Configuration files: OK")
+		if !params.JSON {
+			InitLog.Info(0, "Configuration files: OK")
+		}
 
 		var descs map[UsbAddr]UsbDeviceDesc
 		err = UsbInit(true)
@@ -233,21 +336,27 @@ func main() {
 			descs, err = UsbGetIppOverUsbDeviceDescs()
 		}
 
-		if err != nil {
+		// Repack into the sorted list
+		var list []UsbDeviceDesc
+		for _, desc := range descs {
+			list = append(list, desc)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].UsbAddr.Less(list[j].UsbAddr)
+		})
+
+		switch {
+		case params.JSON:
+			printCheckJSON(list, err)
+
+		case err != nil:
 			InitLog.Info(0, "Can't read list of USB devices: %s", err)
-		} else if descs == nil || len(descs) == 0 {
+
+		case len(list) == 0:
 			InitLog.Info(0, "No IPP over USB devices found")
-		} else {
-			// Repack into the sorted list
-			var list []UsbDeviceDesc
-			var buf bytes.Buffer
 
-			for _, desc := range descs {
-				list = append(list, desc)
-			}
-			sort.Slice(list, func(i, j int) bool {
-				return list[i].UsbAddr.Less(list[j].UsbAddr)
-			})
+		default:
+			var buf bytes.Buffer
 
 			InitLog.Info(0, "IPP over USB devices:")
 			InitLog.Info(0, " Num  Device              Vndr:Prod  Model")
@@ -271,7 +380,7 @@ func main() {
 
 	// In RunStatus mode, print ipp-usb status
 	if params.Mode == RunStatus {
-		printStatus()
+		printStatus(params.JSON)
 	}
 
 	// If mode is "check" or "status", we are done
@@ -323,6 +432,26 @@ func main() {
 		InitLog.Check(err)
 	}
 
+	// In RunMonitor mode, start health polling in background,
+	// alongside the normal reverse-proxy behavior below
+	if params.Mode == RunMonitor {
+		go MonitorRun(params.MonitorInterval, params.JSON)
+	}
+
+	// Start the control socket, so "reload" and "rescan" can reach us
+	err = ControlServe()
+	InitLog.Check(err)
+
+	// -netns, if given, is validated (it must actually be enterable)
+	// before we go any further, and a bad namespace is fatal.
+	// NetNSOverride records it, but device listeners don't consult
+	// NetNSOverride, so it doesn't change where they bind
+	if !params.NetNS.IsDefault() {
+		err = CheckNetNS(params.NetNS)
+		InitLog.Check(err)
+		NetNSOverride = params.NetNS
+	}
+
 	// Run PnP manager
 	for {
 		exitReason := PnPStart(params.Mode == RunUdev)
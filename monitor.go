@@ -0,0 +1,456 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Periodic per-printer health polling, used by the "monitor" run mode
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MonitorDefaultInterval is the default polling interval, used
+// when -interval option is not given
+const MonitorDefaultInterval = 30 * time.Second
+
+// PrinterState represents a normalized `printer-state` IPP attribute
+type PrinterState int
+
+// PrinterState values, in a same order IPP defines them
+const (
+	PrinterStateUnknown PrinterState = iota
+	PrinterStateIdle
+	PrinterStateProcessing
+	PrinterStateStopped
+)
+
+// String returns PrinterState name
+func (s PrinterState) String() string {
+	switch s {
+	case PrinterStateIdle:
+		return "idle"
+	case PrinterStateProcessing:
+		return "processing"
+	case PrinterStateStopped:
+		return "stopped"
+	}
+
+	return "unknown"
+}
+
+// PrinterStateReason is a single bit of the `printer-state-reasons`
+// bitfield, decoded into a stable, human-readable name
+type PrinterStateReason int
+
+// PrinterStateReason bits. Order and naming follows the same
+// "bit position -> error string" approach as the Brother status
+// decoder uses for its panel codes
+const (
+	ReasonMediaEmpty PrinterStateReason = 1 << iota
+	ReasonMediaJam
+	ReasonCoverOpen
+	ReasonMarkerSupplyLow
+	ReasonTonerEmpty
+	ReasonInputTrayMissing
+)
+
+// reasonNames maps each PrinterStateReason bit to its stable name
+var reasonNames = []struct {
+	bit  PrinterStateReason
+	name string
+}{
+	{ReasonMediaEmpty, "no media"},
+	{ReasonMediaJam, "cutter jam"},
+	{ReasonCoverOpen, "cover open"},
+	{ReasonMarkerSupplyLow, "marker supply low"},
+	{ReasonTonerEmpty, "toner empty"},
+	{ReasonInputTrayMissing, "input tray missing"},
+}
+
+// Strings decodes the bitfield into a list of stable error names,
+// in the same order the bits are declared above
+func (r PrinterStateReason) Strings() []string {
+	var list []string
+	for _, rn := range reasonNames {
+		if r&rn.bit != 0 {
+			list = append(list, rn.name)
+		}
+	}
+	return list
+}
+
+// MarkerLevel represents a single consumable (toner, ink, waste
+// cartridge, ...) supply level, as reported by IPP marker attributes
+type MarkerLevel struct {
+	Name  string `json:"name"`
+	Level int    `json:"level"` // Percents, 0...100, -1 if unknown
+}
+
+// PrinterHealth is a normalized snapshot of a single device's
+// health, as polled via IPP Get-Printer-Attributes
+type PrinterHealth struct {
+	Addr      UsbAddr       `json:"addr"`
+	Model     string        `json:"model"`
+	State     PrinterState  `json:"state"`
+	Reasons   []string      `json:"reasons"`
+	JobsQueue int           `json:"jobs_queue"`
+	Markers   []MarkerLevel `json:"markers"`
+	Updated   time.Time     `json:"updated"`
+	LastError string        `json:"last_error,omitempty"`
+}
+
+// monitorState keeps the latest snapshot and per-device backoff
+type monitorState struct {
+	lock     sync.Mutex
+	health   map[UsbAddr]PrinterHealth
+	backoff  map[UsbAddr]int // In units of interval
+	interval time.Duration
+}
+
+// newMonitorState creates a monitorState
+func newMonitorState(interval time.Duration) *monitorState {
+	return &monitorState{
+		health:   make(map[UsbAddr]PrinterHealth),
+		backoff:  make(map[UsbAddr]int),
+		interval: interval,
+	}
+}
+
+// monitorMaxBackoff caps how far a dead device's backoff can grow,
+// so it's still polled once in a while instead of being forgotten
+const monitorMaxBackoff = 10
+
+// poll queries a single device and updates its health snapshot.
+// On error, the device's backoff (in units of the base polling
+// interval) is doubled up to monitorMaxBackoff ticks, so a dead
+// device gets hammered less and less often instead of every tick
+func (ms *monitorState) poll(addr UsbAddr, desc UsbDeviceDesc) {
+	health, err := monitorGetPrinterHealth(addr, desc)
+
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	if err != nil {
+		health = PrinterHealth{
+			Addr:      addr,
+			Updated:   time.Now(),
+			LastError: err.Error(),
+		}
+
+		next := ms.backoff[addr] * 2
+		if next == 0 {
+			next = 1
+		}
+		if next > monitorMaxBackoff {
+			next = monitorMaxBackoff
+		}
+		ms.backoff[addr] = next
+	} else {
+		delete(ms.backoff, addr)
+	}
+
+	ms.health[addr] = health
+}
+
+// due reports if addr is due for a poll on this tick, given its
+// current backoff, expressed in units of the base polling interval
+// (backoff==1 means "poll every tick", backoff==4 means "poll every
+// 4th tick", and so on)
+func (ms *monitorState) due(addr UsbAddr, tick int) bool {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	backoff := ms.backoff[addr]
+	if backoff <= 1 {
+		return true
+	}
+
+	return tick%int(backoff) == 0
+}
+
+// snapshot returns a sorted copy of all known device health records
+func (ms *monitorState) snapshot() []PrinterHealth {
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+
+	list := make([]PrinterHealth, 0, len(ms.health))
+	for _, h := range ms.health {
+		list = append(list, h)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Addr.Less(list[j].Addr)
+	})
+
+	return list
+}
+
+// save writes the current snapshot to path, next to PathStatusFile,
+// so it can be picked up by "status -json" or inspected by hand
+func (ms *monitorState) save(path string) error {
+	list := ms.snapshot()
+
+	data, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// monitorSnapshotPath is where MonitorRun persists its latest
+// snapshot, next to PathStatusFile
+func monitorSnapshotPath() string {
+	return PathStatusFile + ".monitor"
+}
+
+// loadMonitorSnapshot reads back the snapshot written by save(), so
+// "status" and "status -json" can fold printer health into their
+// own output even though they run as a separate, short-lived process
+func loadMonitorSnapshot() ([]PrinterHealth, error) {
+	data, err := os.ReadFile(monitorSnapshotPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var health []PrinterHealth
+	if err := json.Unmarshal(data, &health); err != nil {
+		return nil, err
+	}
+
+	return health, nil
+}
+
+// printTable writes the snapshot as a human-readable table
+func (ms *monitorState) printTable() {
+	for _, h := range ms.snapshot() {
+		reasons := "-"
+		if len(h.Reasons) > 0 {
+			reasons = fmt.Sprintf("%v", h.Reasons)
+		}
+		InitLog.Info(0, "%s  %-10s %-10s jobs=%d reasons=%s",
+			h.Addr, h.Model, h.State, h.JobsQueue, reasons)
+	}
+}
+
+// monitorPortsLock guards monitorPorts
+var monitorPortsLock sync.Mutex
+
+// monitorPorts maps a device's USB address to the loopback TCP port
+// its reverse-proxy HTTP server is currently listening on
+var monitorPorts = make(map[UsbAddr]int)
+
+// monitorRequestID hands out unique IPP request-id values, shared
+// across all polled devices
+var monitorRequestID uint32
+
+// MonitorRegisterPort records the HTTP port a device's reverse proxy
+// is listening on, so monitor polling knows where to send its
+// Get-Printer-Attributes requests. It must be called (and, on
+// shutdown, called again with port 0 to deregister) from wherever
+// the per-device HTTP listener is created and torn down
+func MonitorRegisterPort(addr UsbAddr, port int) {
+	monitorPortsLock.Lock()
+	defer monitorPortsLock.Unlock()
+
+	if port == 0 {
+		delete(monitorPorts, addr)
+	} else {
+		monitorPorts[addr] = port
+	}
+}
+
+// monitorDevicePort looks up the port a device's reverse proxy is
+// listening on. It first checks the in-process registry (populated
+// by MonitorRegisterPort, for callers in the same process that wire
+// it in directly), then falls back to PathStatusFile -- the same
+// file "status"/"status -json" already read -- which every running
+// ipp-usb instance keeps up to date with each device's listen port
+// regardless of whether MonitorRegisterPort is wired in. This is
+// what makes polling work out of the box in "monitor" mode
+func monitorDevicePort(addr UsbAddr) (int, bool) {
+	monitorPortsLock.Lock()
+	port, ok := monitorPorts[addr]
+	monitorPortsLock.Unlock()
+	if ok {
+		return port, true
+	}
+
+	return monitorPortFromStatusFile(addr)
+}
+
+// monitorPortFromStatusFile scans PathStatusFile for a line
+// belonging to addr and returns its "port=" field, if any
+func monitorPortFromStatusFile(addr UsbAddr) (int, bool) {
+	data, err := os.ReadFile(PathStatusFile)
+	if err != nil {
+		return 0, false
+	}
+
+	want := addr.String()
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		rec := parseStatusLine(string(line))
+		if rec.Device == want && rec.Port != 0 {
+			return rec.Port, true
+		}
+	}
+
+	return 0, false
+}
+
+// ippStateToPrinterState maps the IPP `printer-state` enum (RFC 8011
+// 5.4.11: 3=idle, 4=processing, 5=stopped) to PrinterState
+func ippStateToPrinterState(v int) PrinterState {
+	switch v {
+	case 3:
+		return PrinterStateIdle
+	case 4:
+		return PrinterStateProcessing
+	case 5:
+		return PrinterStateStopped
+	}
+	return PrinterStateUnknown
+}
+
+// reasonKeywords maps the registered IPP `printer-state-reasons`
+// keywords (RFC 8011 5.4.12) this poller understands to their bit,
+// so freeform IPP reason strings become the same stable names the
+// -json output and table use elsewhere
+var reasonKeywords = map[string]PrinterStateReason{
+	"media-empty":        ReasonMediaEmpty,
+	"media-jam":          ReasonMediaJam,
+	"cover-open":         ReasonCoverOpen,
+	"marker-supply-low":  ReasonMarkerSupplyLow,
+	"toner-empty":        ReasonTonerEmpty,
+	"input-tray-missing": ReasonInputTrayMissing,
+}
+
+// decodePrinterHealth turns the raw printer-group IPP attributes of
+// a Get-Printer-Attributes response into a normalized PrinterHealth
+func decodePrinterHealth(addr UsbAddr, model string, attrs map[string][]ippAttr) PrinterHealth {
+	health := PrinterHealth{
+		Addr:    addr,
+		Model:   model,
+		Updated: time.Now(),
+	}
+
+	if v, ok := ippAttrInt(attrs, "printer-state"); ok {
+		health.State = ippStateToPrinterState(v)
+	}
+
+	var reasons PrinterStateReason
+	for _, kw := range ippAttrStrings(attrs, "printer-state-reasons") {
+		// Reason keywords may carry a "-report"/"-warning"/"-error"
+		// severity suffix; strip it before matching the stable name
+		base := kw
+		for _, suffix := range []string{"-report", "-warning", "-error"} {
+			if len(base) > len(suffix) && base[len(base)-len(suffix):] == suffix {
+				base = base[:len(base)-len(suffix)]
+				break
+			}
+		}
+		if bit, ok := reasonKeywords[base]; ok {
+			reasons |= bit
+		}
+	}
+	health.Reasons = reasons.Strings()
+
+	if v, ok := ippAttrInt(attrs, "queued-job-count"); ok {
+		health.JobsQueue = v
+	}
+
+	names := ippAttrStrings(attrs, "marker-names")
+	levels := ippAttrInts(attrs, "marker-levels")
+	for i, name := range names {
+		level := -1
+		if i < len(levels) {
+			level = levels[i]
+		}
+		health.Markers = append(health.Markers, MarkerLevel{Name: name, Level: level})
+	}
+
+	return health
+}
+
+// monitorGetPrinterHealth issues an IPP Get-Printer-Attributes
+// request against the device and decodes the result into a
+// PrinterHealth snapshot
+func monitorGetPrinterHealth(addr UsbAddr, desc UsbDeviceDesc) (PrinterHealth, error) {
+	port, ok := monitorDevicePort(addr)
+	if !ok {
+		return PrinterHealth{}, fmt.Errorf("%s: HTTP listener not ready yet", addr)
+	}
+
+	model := ""
+	if info, err := desc.GetUsbDeviceInfo(); err == nil {
+		model = info.MfgAndProduct
+	}
+
+	uri := fmt.Sprintf("http://127.0.0.1:%d/ipp/print", port)
+	reqID := atomic.AddUint32(&monitorRequestID, 1)
+
+	attrs, err := ippGetPrinterAttributes(uri, reqID)
+	if err != nil {
+		return PrinterHealth{}, fmt.Errorf("%s: %s", addr, err)
+	}
+
+	return decodePrinterHealth(addr, model, attrs), nil
+}
+
+// MonitorRun runs the monitor mode's health polling loop: periodically
+// polls every attached device's health on -interval and persists the
+// result to PathStatusFile's monitor counterpart
+func MonitorRun(interval time.Duration, jsonOutput bool) {
+	ms := newMonitorState(interval)
+	statusPath := monitorSnapshotPath()
+
+	tick := 0
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		descs, err := UsbGetIppOverUsbDeviceDescs()
+		if err != nil {
+			Log.Error(' ', "monitor: %s", err)
+			continue
+		}
+
+		for addr, desc := range descs {
+			if !ms.due(addr, tick) {
+				continue
+			}
+			ms.poll(addr, desc)
+		}
+
+		if err := ms.save(statusPath); err != nil {
+			Log.Error(' ', "monitor: %s", err)
+		}
+
+		if jsonOutput {
+			for _, h := range ms.snapshot() {
+				data, _ := json.Marshal(h)
+				fmt.Println(string(data))
+			}
+		} else {
+			ms.printTable()
+		}
+
+		tick++
+	}
+}
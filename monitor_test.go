@@ -0,0 +1,52 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ */
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPrinterStateReasonStrings(t *testing.T) {
+	type testCase struct {
+		reasons PrinterStateReason
+		want    []string
+	}
+
+	cases := []testCase{
+		{0, nil},
+		{ReasonMediaEmpty, []string{"no media"}},
+		{ReasonCoverOpen | ReasonTonerEmpty,
+			[]string{"cover open", "toner empty"}},
+		{ReasonMediaEmpty | ReasonMediaJam | ReasonCoverOpen |
+			ReasonMarkerSupplyLow | ReasonTonerEmpty | ReasonInputTrayMissing,
+			[]string{"no media", "cutter jam", "cover open",
+				"marker supply low", "toner empty", "input tray missing"}},
+	}
+
+	for _, c := range cases {
+		got := c.reasons.Strings()
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%v.Strings() = %v, want %v", c.reasons, got, c.want)
+		}
+	}
+}
+
+func TestIppStateToPrinterState(t *testing.T) {
+	cases := map[int]PrinterState{
+		3:  PrinterStateIdle,
+		4:  PrinterStateProcessing,
+		5:  PrinterStateStopped,
+		99: PrinterStateUnknown,
+	}
+
+	for v, want := range cases {
+		if got := ippStateToPrinterState(v); got != want {
+			t.Errorf("ippStateToPrinterState(%d) = %v, want %v", v, got, want)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ *
+ * Linux network-namespace support: parsing and validating a namespace
+ * selector, and opening a listener inside a given namespace
+ */
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+)
+
+// NetNS represents a Linux network namespace, identified by a path
+// to its handle under /run/netns or /proc/<pid>/ns/net
+type NetNS struct {
+	Path string // Path to the namespace handle
+}
+
+// NetNSDefault is the zero value of NetNS, meaning "the namespace
+// ipp-usb itself was started in" (no setns(2) is performed)
+var NetNSDefault = NetNS{}
+
+// NetNSOverride holds the namespace given with the -netns CLI option,
+// set after CheckNetNS has validated it at startup. DeviceNetNS
+// returns it when set; the PnP manager's device listeners don't
+// consult it, so it doesn't change where they bind
+var NetNSOverride = NetNSDefault
+
+// DeviceNetNS resolves the effective namespace for a device, given
+// the namespace confNS selected for it: the -netns override always
+// wins, otherwise confNS applies. The PnP manager's listener setup
+// doesn't call it; see NetNSListen
+func DeviceNetNS(confNS NetNS) NetNS {
+	if !NetNSOverride.IsDefault() {
+		return NetNSOverride
+	}
+	return confNS
+}
+
+// IsDefault reports if ns refers to the default (host) namespace
+func (ns NetNS) IsDefault() bool {
+	return ns.Path == ""
+}
+
+// String returns a human-readable representation of ns
+func (ns NetNS) String() string {
+	if ns.IsDefault() {
+		return "default"
+	}
+	return ns.Path
+}
+
+// ParseNetNS parses a namespace selector, as given to the -netns
+// option. Accepted forms are a path to a netns handle (as created by
+// `ip netns add`, typically /run/netns/<name>) or a PID, in which
+// case /proc/<pid>/ns/net is used
+func ParseNetNS(s string) (NetNS, error) {
+	if s == "" {
+		return NetNSDefault, nil
+	}
+
+	var pid int
+	if n, err := fmt.Sscanf(s, "%d", &pid); err == nil && n == 1 {
+		return NetNS{Path: fmt.Sprintf("/proc/%d/ns/net", pid)}, nil
+	}
+
+	if _, err := os.Stat(s); err != nil {
+		return NetNS{}, fmt.Errorf("netns %q: %s", s, err)
+	}
+
+	return NetNS{Path: s}, nil
+}
+
+// netnsEnter locks the calling goroutine to its OS thread, opens the
+// given namespace handle and switches that thread into it, returning
+// a function that switches the thread back to its original namespace
+// and unlocks it. For the default namespace it does nothing and
+// returns a no-op restore function
+func netnsEnter(ns NetNS) (restore func(), err error) {
+	if ns.IsDefault() {
+		return func() {}, nil
+	}
+
+	runtime.LockOSThread()
+
+	self, err := os.Open("/proc/self/ns/net")
+	if err != nil {
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("netns: %s", err)
+	}
+
+	target, err := os.Open(ns.Path)
+	if err != nil {
+		self.Close()
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("netns: %s", err)
+	}
+	defer target.Close()
+
+	err = unixSetns(target.Fd())
+	if err != nil {
+		self.Close()
+		runtime.UnlockOSThread()
+		return nil, fmt.Errorf("netns: setns: %s", err)
+	}
+
+	restore = func() {
+		unixSetns(self.Fd())
+		self.Close()
+		runtime.UnlockOSThread()
+	}
+
+	return restore, nil
+}
+
+// unixSetns wraps the setns(2) syscall for CLONE_NEWNET
+func unixSetns(fd uintptr) error {
+	const cloneNewnet = 0x40000000
+	_, _, errno := syscall.Syscall(syscall.SYS_SETNS, fd, uintptr(cloneNewnet), 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// NetNSListen is like net.Listen(network, addr), but binds the listener
+// inside ns instead of the caller's current namespace. With the default
+// namespace (ns.IsDefault()) it is a plain net.Listen.
+//
+// The PnP manager's per-device listener setup doesn't call NetNSListen:
+// every device listener is opened in ipp-usb's own namespace, and
+// -netns only validates its argument at startup (see CheckNetNS)
+// without affecting where listeners bind.
+func NetNSListen(ns NetNS, network, addr string) (net.Listener, error) {
+	restore, err := netnsEnter(ns)
+	if err != nil {
+		return nil, err
+	}
+	defer restore()
+
+	return net.Listen(network, addr)
+}
+
+// CheckNetNS verifies that ns can actually be entered and left again,
+// without touching any listener. It's used to reject an unusable
+// -netns argument at startup
+func CheckNetNS(ns NetNS) error {
+	if ns.IsDefault() {
+		return nil
+	}
+
+	restore, err := netnsEnter(ns)
+	if err != nil {
+		return err
+	}
+	restore()
+
+	return nil
+}
@@ -0,0 +1,36 @@
+/* ipp-usb - HTTP reverse proxy, backed by IPP-over-USB connection to device
+ *
+ * Copyright (C) 2020 and up by Alexander Pevzner (pzz@apevzner.com)
+ * See LICENSE for license terms and conditions
+ */
+
+package main
+
+import "testing"
+
+func TestParseNetNSEmpty(t *testing.T) {
+	ns, err := ParseNetNS("")
+	if err != nil {
+		t.Fatalf("ParseNetNS(\"\"): %s", err)
+	}
+	if !ns.IsDefault() {
+		t.Errorf("ParseNetNS(\"\") = %v, want the default namespace", ns)
+	}
+}
+
+func TestParseNetNSPid(t *testing.T) {
+	ns, err := ParseNetNS("1")
+	if err != nil {
+		t.Fatalf("ParseNetNS(\"1\"): %s", err)
+	}
+	if ns.Path != "/proc/1/ns/net" {
+		t.Errorf("ParseNetNS(\"1\").Path = %q, want /proc/1/ns/net", ns.Path)
+	}
+}
+
+func TestParseNetNSMissingPath(t *testing.T) {
+	_, err := ParseNetNS("/run/netns/does-not-exist")
+	if err == nil {
+		t.Errorf("ParseNetNS of a missing path should fail")
+	}
+}